@@ -15,6 +15,7 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 )
 
@@ -30,20 +31,110 @@ import (
 // 	     concatjs.ServeConcatenatedJS("my/app/web_srcs.MF", ".", [], [], nil))
 //
 // Relative paths in the manifest are resolved relative to the path given as root.
-func ServeConcatenatedJS(manifestPath string, root string, preScripts []string, postScripts []string, fs FileSystem) http.Handler {
+// opts customize the handler, see the Option constructors below.
+func ServeConcatenatedJS(manifestPath string, root string, preScripts []string, postScripts []string, fs FileSystem, opts ...Option) http.Handler {
+	return ServeConcatenatedJSManifests([]string{manifestPath}, root, preScripts, postScripts, fs, opts...)
+}
+
+// ServeConcatenatedJSManifests is like ServeConcatenatedJS, but serves the files
+// listed in all of manifestPaths, in order. All manifests share one FileCache.
+func ServeConcatenatedJSManifests(manifestPaths []string, root string, preScripts []string, postScripts []string, fs FileSystem, opts ...Option) http.Handler {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	var lock sync.Mutex // Guards cache.
 	cache := NewFileCache(root, fs)
+	if o.evalWrapper != nil {
+		cache.evalWrapper = o.evalWrapper
+	}
+	if o.googModuleWrapper != nil {
+		cache.googModuleWrapper = o.googModuleWrapper
+	}
+	if o.esModuleWrapper != nil {
+		cache.esModuleWrapper = o.esModuleWrapper
+	}
+	cache.lookupEnv = o.lookupEnv
 
-	manifestPath = filepath.Join(root, manifestPath)
+	rootedManifestPaths := make([]string, len(manifestPaths))
+	for i, manifestPath := range manifestPaths {
+		rootedManifestPaths[i] = filepath.Join(root, manifestPath)
+	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if o.corsOrigin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", o.corsOrigin)
+			if r.Method == "OPTIONS" {
+				writePreflight(w, r)
+				return
+			}
+		}
 		w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
-		files, err := manifestFiles(manifestPath)
-		if err != nil {
+		var manifests [][]string
+		var files []string
+		var errs []error
+		for _, manifestPath := range rootedManifestPaths {
+			mf, err := manifestFiles(manifestPath, cache.fs)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			manifests = append(manifests, mf)
+			files = append(files, mf...)
+		}
+		if len(errs) > 0 {
 			w.WriteHeader(http.StatusInternalServerError)
-			writeJSError(w, "Failed to read manifest: %v", err)
+			for _, err := range errs {
+				writeJSError(w, "Failed to read manifest: %v", err)
+			}
 			return
 		}
+
+		// Protect the cache with a lock because it's possible for multiple requests
+		// to be handled in parallel.
+		lock.Lock()
+		defer lock.Unlock()
+		cache.refreshFiles(files)
+
+		// Dedup compares the paths the cache resolved entries to, so that
+		// entries only differing before variable expansion are caught as well.
+		if o.dedupWithinManifest || o.dedupAcrossManifests {
+			files = nil
+			seen := map[string]bool{}
+			for i, mf := range manifests {
+				if o.dedupWithinManifest {
+					mf = cache.dedupManifestFiles(rootedManifestPaths[i], mf)
+				}
+				if o.dedupAcrossManifests {
+					files = cache.appendUnseen(files, mf, seen)
+				} else {
+					files = append(files, mf...)
+				}
+			}
+		}
+
+		// The response only changes when a manifest or one of its files does,
+		// so the latest of their mtimes serves as the Last-Modified validator.
+		lastModified := cache.lastModified(files)
+		for _, manifestPath := range rootedManifestPaths {
+			mt, err := cache.fs.statMtime(manifestPath)
+			if err != nil {
+				lastModified = time.Time{}
+				break
+			}
+			if mt.After(lastModified) {
+				lastModified = mt
+			}
+		}
+		if !lastModified.IsZero() {
+			w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+			if notModified(r, lastModified) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
 		var writer io.Writer = w
 		if acceptGzip(r.Header) {
 			// NB: gzip is not supported in App Engine, as the header is stripped:
@@ -65,11 +156,7 @@ func ServeConcatenatedJS(manifestPath string, root string, preScripts []string,
 			fmt.Fprint(writer, "\n")
 		}
 
-		// Protect the cache with a lock because it's possible for multiple requests
-		// to be handled in parallel.
-		lock.Lock()
-		cache.WriteFiles(writer, files)
-		lock.Unlock()
+		cache.writeFiles(writer, files)
 
 		// Write out post scripts
 		for _, s := range postScripts {
@@ -80,6 +167,100 @@ func ServeConcatenatedJS(manifestPath string, root string, preScripts []string,
 	})
 }
 
+// Option configures optional behavior of the handler returned by ServeConcatenatedJS.
+type Option func(*options)
+
+type options struct {
+	corsOrigin           string
+	evalWrapper          *template.Template
+	googModuleWrapper    *template.Template
+	esModuleWrapper      *template.Template
+	dedupAcrossManifests bool
+	dedupWithinManifest  bool
+	lookupEnv            func(string) (string, bool)
+}
+
+// CORSOrigin makes the handler send an Access-Control-Allow-Origin header with
+// the given origin, which may be "*", and answer OPTIONS preflight requests.
+// Without it, no CORS headers are sent.
+func CORSOrigin(origin string) Option {
+	return func(o *options) {
+		o.corsOrigin = origin
+	}
+}
+
+// EvalWrapper replaces the template that wraps the contents of each file
+// declaring neither a goog.module nor a goog.declareModuleId, which defaults
+// to an eval('...') call. The template is executed with a WrapperData value.
+func EvalWrapper(t *template.Template) Option {
+	return func(o *options) {
+		o.evalWrapper = t
+	}
+}
+
+// GoogModuleWrapper replaces the template that wraps the contents of each file
+// declaring a goog.module, which defaults to a goog.loadModule('...') call. The
+// template is executed with a WrapperData value.
+func GoogModuleWrapper(t *template.Template) Option {
+	return func(o *options) {
+		o.googModuleWrapper = t
+	}
+}
+
+// EsModuleWrapper replaces the template that wraps the contents of each ES
+// module calling goog.declareModuleId. The default appends the file to the
+// page as an inline <script type="module">, so the browser runs it as a native
+// ES module once the concatenated sources have run, resolving its imports
+// against the page URL. Closure's base.js only accepts goog.declareModuleId
+// from within its own ES6 module loader; apps relying on that pass a template
+// handing the contents to the loader instead. The template is executed with a
+// WrapperData value.
+func EsModuleWrapper(t *template.Template) Option {
+	return func(o *options) {
+		o.esModuleWrapper = t
+	}
+}
+
+// DedupAcrossManifests makes the handler serve a file listed by more than one
+// manifest only at its first occurrence. Duplicates within a single manifest are
+// kept.
+func DedupAcrossManifests() Option {
+	return func(o *options) {
+		o.dedupAcrossManifests = true
+	}
+}
+
+// DedupWithinManifest makes the handler serve a file listed more than once by
+// the same manifest only at its first occurrence, logging a warning for each
+// dropped entry.
+func DedupWithinManifest() Option {
+	return func(o *options) {
+		o.dedupWithinManifest = true
+	}
+}
+
+// ExpandManifestPaths makes the handler expand ${VAR} and $VAR references in
+// the paths listed in manifests, using lookup to find the variables' values.
+// Pass os.LookupEnv to expand from the environment. The response and the
+// sourceURLs name files by their expanded path, relative to root if they lie
+// below it, and DedupWithinManifest and DedupAcrossManifests compare expanded
+// paths. A path referencing a variable that lookup does not know fails to load
+// with an error naming it.
+func ExpandManifestPaths(lookup func(name string) (string, bool)) Option {
+	return func(o *options) {
+		o.lookupEnv = lookup
+	}
+}
+
+// writePreflight answers a CORS preflight request for the concatenated sources.
+func writePreflight(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+	if h := r.Header.Get("Access-Control-Request-Headers"); h != "" {
+		w.Header().Set("Access-Control-Allow-Headers", h)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 var acceptHeader = http.CanonicalHeaderKey("Accept-Encoding")
 
 func acceptGzip(h http.Header) bool {
@@ -93,6 +274,20 @@ func acceptGzip(h http.Header) bool {
 	return false
 }
 
+// notModified reports whether r carries an If-Modified-Since header that is
+// satisfied by lastModified.
+func notModified(r *http.Request, lastModified time.Time) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// HTTP dates have a granularity of one second.
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
 // FileSystem is the interface to reading files from disk.
 // It's abstracted into an interface to allow tests to replace it.
 type FileSystem interface {
@@ -121,6 +316,12 @@ type FileCache struct {
 	fs   FileSystem
 	root string
 
+	evalWrapper       *template.Template
+	googModuleWrapper *template.Template
+	esModuleWrapper   *template.Template
+	// lookupEnv, if non-nil, is used to expand variables in paths.
+	lookupEnv func(string) (string, bool)
+
 	entries map[string]*cacheEntry
 }
 
@@ -132,9 +333,12 @@ func NewFileCache(root string, fs FileSystem) *FileCache {
 		fs = &realFileSystem{}
 	}
 	return &FileCache{
-		root:    root,
-		fs:      fs,
-		entries: map[string]*cacheEntry{},
+		root:              root,
+		fs:                fs,
+		evalWrapper:       defaultEvalWrapper,
+		googModuleWrapper: defaultGoogModuleWrapper,
+		esModuleWrapper:   defaultEsModuleWrapper,
+		entries:           map[string]*cacheEntry{},
 	}
 }
 
@@ -144,16 +348,62 @@ type cacheEntry struct {
 	err      error
 	mtime    time.Time
 	contents []byte
+	// path is the path of the file with variables expanded, relative to the
+	// cache root if possible. It is empty if the path could not be expanded.
+	path string
+	// filename names the file that contents were read from.
+	filename string
 }
 
-// manifestFiles parses a manifest, returning a list of the files in the manifest.
-func manifestFiles(manifest string) ([]string, error) {
-	f, err := os.Open(manifest)
+// manifestFiles parses a manifest read through fs, returning a list of the
+// files in the manifest.
+func manifestFiles(manifest string, fs FileSystem) ([]string, error) {
+	contents, err := fs.readFile(manifest)
 	if err != nil {
 		return nil, fmt.Errorf("could not read manifest %s: %s", manifest, err)
 	}
-	defer f.Close()
-	return manifestFilesFromReader(f)
+	return manifestFilesFromReader(bytes.NewReader(contents))
+}
+
+// servedPath returns the path a file in the cache is served as, which differs
+// from the manifest entry if variables in it were expanded. The cache entry
+// must have been refreshed by refreshFiles before.
+func (cache *FileCache) servedPath(path string) string {
+	if ce := cache.entries[path]; ce != nil && ce.path != "" {
+		return ce.path
+	}
+	return path
+}
+
+// dedupManifestFiles removes entries from the files of manifest that are
+// served as the same path, preserving the order of first occurrences.
+func (cache *FileCache) dedupManifestFiles(manifest string, files []string) []string {
+	seen := map[string]bool{}
+	var deduped []string
+	for _, path := range files {
+		served := cache.servedPath(path)
+		if seen[served] {
+			log.Printf("Ignoring duplicate entry %s in manifest %s", path, manifest)
+			continue
+		}
+		seen[served] = true
+		deduped = append(deduped, path)
+	}
+	return deduped
+}
+
+// appendUnseen appends the files of one manifest whose served paths are not in
+// seen to files, then marks them all as seen.
+func (cache *FileCache) appendUnseen(files, manifest []string, seen map[string]bool) []string {
+	for _, path := range manifest {
+		if !seen[cache.servedPath(path)] {
+			files = append(files, path)
+		}
+	}
+	for _, path := range manifest {
+		seen[cache.servedPath(path)] = true
+	}
+	return files
 }
 
 // manifestFilesFromReader is a helper for manifestFiles, split out for testing.
@@ -188,12 +438,20 @@ func (cache *FileCache) WriteFiles(w io.Writer, files []string) error {
 	// Note that refreshFiles cannot fail; any errors encountering while refreshing
 	// are stored in the cache entry and streamed into the response.
 	cache.refreshFiles(files)
+	return cache.writeFiles(w, files)
+}
 
+// writeFiles streams the cached contents of files into an io.Writer. The cache
+// entries must have been refreshed by refreshFiles before.
+func (cache *FileCache) writeFiles(w io.Writer, files []string) error {
 	for _, path := range files {
+		ce := cache.entries[path]
+		if ce.path != "" {
+			path = ce.path
+		}
 		if _, err := fmt.Fprintf(w, "// %s\n", path); err != nil {
 			return err
 		}
-		ce := cache.entries[path]
 		if ce.err != nil {
 			writeJSError(w, "loading %s failed: %s", path, ce.err)
 			continue
@@ -205,26 +463,92 @@ func (cache *FileCache) WriteFiles(w io.Writer, files []string) error {
 	return nil
 }
 
+// lastModified returns the latest mtime of the given files, or the zero time if
+// any of them failed to load. The cache entries must have been refreshed by
+// refreshFiles before.
+func (cache *FileCache) lastModified(files []string) time.Time {
+	var latest time.Time
+	for _, path := range files {
+		ce := cache.entries[path]
+		if ce.err != nil {
+			return time.Time{}
+		}
+		if ce.mtime.After(latest) {
+			latest = ce.mtime
+		}
+	}
+	return latest
+}
+
 // refresh ensures a single cacheEntry is up to date.  It stat()s and
 // potentially reads the contents of the file it is caching.
-func (e *cacheEntry) refresh(root, path string, fs FileSystem) error {
-	mt, err := fs.statMtime(filepath.Join(root, path))
+func (e *cacheEntry) refresh(cache *FileCache, path string) error {
+	e.path = ""
+	path, err := cache.expandPath(path)
 	if err != nil {
 		return err
 	}
-	if e.mtime == mt && e.contents != nil {
+	e.path = path
+	filename := path
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(cache.root, filename)
+	}
+	mt, err := cache.fs.statMtime(filename)
+	if err != nil {
+		return err
+	}
+	// The expansion of path may resolve to another file than last time.
+	if e.mtime == mt && e.contents != nil && e.filename == filename {
 		return nil // up to date
 	}
 
-	contents, err := fileContents(root, path, fs)
+	contents, err := cache.fileContents(filename, path)
 	if err != nil {
 		return err
 	}
 	e.mtime = mt
 	e.contents = contents
+	e.filename = filename
 	return nil
 }
 
+// expandPath expands variables in a path in the cache if the cache has a
+// lookupEnv. Expanded absolute paths below the cache root are made relative to
+// it, so that they read well in sourceURLs.
+func (cache *FileCache) expandPath(path string) (string, error) {
+	if cache.lookupEnv == nil {
+		return path, nil
+	}
+	var unset []string
+	seen := map[string]bool{}
+	expanded := os.Expand(path, func(name string) string {
+		v, ok := cache.lookupEnv(name)
+		if !ok && !seen[name] {
+			seen[name] = true
+			unset = append(unset, name)
+		}
+		return v
+	})
+	switch len(unset) {
+	case 0:
+	case 1:
+		return "", fmt.Errorf("variable %s is not set", unset[0])
+	default:
+		return "", fmt.Errorf("variables %s are not set", strings.Join(unset, ", "))
+	}
+	if !filepath.IsAbs(expanded) {
+		return expanded, nil
+	}
+	root, err := filepath.Abs(cache.root)
+	if err != nil {
+		return expanded, nil
+	}
+	if rel, err := filepath.Rel(root, expanded); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return rel, nil
+	}
+	return expanded, nil
+}
+
 // refreshFiles stats the given files and updates the cache for them.
 func (cache *FileCache) refreshFiles(files []string) {
 	// Stating many files asynchronously is faster on network file systems.
@@ -236,18 +560,29 @@ func (cache *FileCache) refreshFiles(files []string) {
 	}
 	work := make(chan workItem)
 
+	// A file may be listed several times, but each cache entry must only be
+	// refreshed by a single worker.
+	var unique []string
+	seen := map[string]bool{}
+	for _, path := range files {
+		if !seen[path] {
+			seen[path] = true
+			unique = append(unique, path)
+		}
+	}
+
 	var wg sync.WaitGroup
-	wg.Add(len(files))
-	for i := 0; i < len(files); i++ {
+	wg.Add(len(unique))
+	for i := 0; i < len(unique); i++ {
 		// TODO(evanm): benchmark limiting this to fewer goroutines.
 		go func() {
 			w := <-work
-			w.entry.err = w.entry.refresh(cache.root, w.path, cache.fs)
+			w.entry.err = w.entry.refresh(cache, w.path)
 			wg.Done()
 		}()
 	}
 
-	for _, path := range files {
+	for _, path := range unique {
 		entry := cache.entries[path]
 		if entry == nil {
 			entry = &cacheEntry{}
@@ -260,7 +595,8 @@ func (cache *FileCache) refreshFiles(files []string) {
 	wg.Wait()
 }
 
-// The maximum number of bytes of a source file to be searched for the "goog.module" declaration.
+// The maximum number of bytes of a source file to be searched for the "goog.module" or
+// "goog.declareModuleId" declaration.
 // Limited to 50,000 bytes to avoid degenerated performance on large compiled JS (e.g. a
 // pre-compiled AngularJS binary).
 const googModuleSearchLimit = 50 * 1000
@@ -268,31 +604,70 @@ const googModuleSearchLimit = 50 * 1000
 // Matches files containing "goog.module", which have to be served slightly differently.
 var googModuleRegExp = regexp.MustCompile(`(?m)^\s*goog\.module\s*\(\s*['"]`)
 
+// Matches ES modules containing "goog.declareModuleId", which cannot be eval'ed.
+var esModuleRegExp = regexp.MustCompile(`(?m)^\s*goog\.declareModuleId\s*\(\s*['"]`)
+
+// WrapperData is the data passed to the templates given to EvalWrapper,
+// GoogModuleWrapper and EsModuleWrapper.
+type WrapperData struct {
+	// Contents holds the file contents escaped for a single quoted JavaScript
+	// string, followed by a sourceURL comment.
+	Contents string
+	// Path is the path of the file as listed in the manifest or, with
+	// ExpandManifestPaths, its expanded path, relative to root if possible. It
+	// is not escaped; use QuotedPath inside JavaScript strings.
+	Path string
+	// QuotedPath holds Path escaped for a single quoted JavaScript string.
+	QuotedPath string
+}
+
+var (
+	defaultEvalWrapper       = template.Must(template.New("eval").Parse("eval('{{.Contents}}');\n"))
+	defaultGoogModuleWrapper = template.Must(template.New("goog.loadModule").Parse("goog.loadModule('{{.Contents}}');\n"))
+	defaultEsModuleWrapper   = template.Must(template.New("script").Parse(`(function() {
+	const script = document.createElement('script');
+	script.type = 'module';
+	script.text = '{{.Contents}}';
+	document.head.appendChild(script);
+})();
+`))
+)
+
 // fileContents returns escaped JS file contents for the given path.
-// The path is resolved relative to root, but the path without root is used as the path
-// in the source map.
-func fileContents(root, path string, fs FileSystem) ([]byte, error) {
-	contents, err := fs.readFile(filepath.Join(root, path))
+// The contents are read from filename, but path is used as the path in the source map.
+func (cache *FileCache) fileContents(filename, path string) ([]byte, error) {
+	contents, err := cache.fs.readFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	var f bytes.Buffer
-	// goog.module files must be wrapped in a goog.loadModule call. Check the first X bytes of the file for it.
+	var quotedPath bytes.Buffer
+	if err := writeJSEscaped(&quotedPath, []byte(path)); err != nil {
+		return nil, err
+	}
+	var escaped bytes.Buffer
+	if err := writeJSEscaped(&escaped, contents); err != nil {
+		log.Printf("Failed to write file contents of %s: %s", path, err)
+		return nil, err
+	}
+	fmt.Fprintf(&escaped, "\\n\\n//# sourceURL=http://concatjs/%s\\n", quotedPath.String())
+
+	// goog.module files must be wrapped in a goog.loadModule call, and ES
+	// modules cannot be eval'ed at all. Check the first X bytes of the file for
+	// their declarations.
+	wrapper := cache.evalWrapper
 	limit := googModuleSearchLimit
 	if len(contents) < limit {
 		limit = len(contents)
 	}
 	if googModuleRegExp.Match(contents[:limit]) {
-		fmt.Fprint(&f, "goog.loadModule('")
-	} else {
-		fmt.Fprint(&f, "eval('")
+		wrapper = cache.googModuleWrapper
+	} else if esModuleRegExp.Match(contents[:limit]) {
+		wrapper = cache.esModuleWrapper
 	}
-	if err := writeJSEscaped(&f, contents); err != nil {
-		log.Printf("Failed to write file contents of %s: %s", path, err)
+	var f bytes.Buffer
+	if err := wrapper.Execute(&f, WrapperData{Contents: escaped.String(), Path: path, QuotedPath: quotedPath.String()}); err != nil {
 		return nil, err
 	}
-	fmt.Fprintf(&f, "\\n\\n//# sourceURL=http://concatjs/%s\\n');\n", path)
-
 	return f.Bytes(), nil
 }
 
@@ -3,9 +3,15 @@ package concatjs
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"text/template"
 	"time"
 )
 
@@ -76,6 +82,115 @@ goog.loadModule('// A module\ngoog.module(\'hello\');\n\n//# sourceURL=http://co
 	}
 }
 
+func TestDeclareModuleId(t *testing.T) {
+	// Pushes the declaration past googModuleSearchLimit.
+	padding := strings.Repeat(" ", googModuleSearchLimit)
+	fs := fakeFileSystem{
+		fakeReadFile: func(filename string) ([]byte, error) {
+			switch filename {
+			case "es_module":
+				return []byte("import {y} from './y.js';\ngoog.declareModuleId('x');\nexport const x = y;"), nil
+			case "late_es_module":
+				return []byte(padding + "\ngoog.declareModuleId('x');"), nil
+			case "module":
+				return []byte("goog.module('hello');"), nil
+			default:
+				return []byte{}, fmt.Errorf("unexpected file read: %s", filename)
+			}
+		},
+		fakeStatMtime: func(filename string) (time.Time, error) {
+			return time.Time{}, nil
+		},
+	}
+
+	cache := NewFileCache("", &fs)
+	var b bytes.Buffer
+	cache.WriteFiles(&b, []string{"es_module", "late_es_module", "module"})
+
+	got := b.String()
+	want := `// es_module
+(function() {
+	const script = document.createElement('script');
+	script.type = 'module';
+	script.text = 'import {y} from \'./y.js\';\ngoog.declareModuleId(\'x\');\nexport const x = y;\n\n//# sourceURL=http://concatjs/es_module\n';
+	document.head.appendChild(script);
+})();
+// late_es_module
+eval('` + padding + `\ngoog.declareModuleId(\'x\');\n\n//# sourceURL=http://concatjs/late_es_module\n');
+// module
+goog.loadModule('goog.module(\'hello\');\n\n//# sourceURL=http://concatjs/module\n');
+`
+	if got != want {
+		t.Errorf("Response differs, want %s, got %s", want, got)
+	}
+}
+
+func TestCustomEsModuleWrapper(t *testing.T) {
+	fs := fakeFileSystem{
+		fakeReadFile: func(filename string) ([]byte, error) {
+			switch filename {
+			case "manifest.MF":
+				return []byte("es_module\n"), nil
+			case "es_module":
+				return []byte("goog.declareModuleId('x');"), nil
+			default:
+				return []byte{}, fmt.Errorf("unexpected file read: %s", filename)
+			}
+		},
+		fakeStatMtime: func(filename string) (time.Time, error) {
+			return time.Time{}, nil
+		},
+	}
+	wrapper := template.Must(template.New("loader").Parse("loader.loadEs6('{{.QuotedPath}}', '{{.Contents}}');\n"))
+
+	handler := ServeConcatenatedJS("manifest.MF", "", nil, nil, &fs, EsModuleWrapper(wrapper))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	got := w.Body.String()
+	want := `// es_module
+loader.loadEs6('es_module', 'goog.declareModuleId(\'x\');\n\n//# sourceURL=http://concatjs/es_module\n');
+`
+	if got != want {
+		t.Errorf("Response differs, want %s, got %s", want, got)
+	}
+}
+
+func TestCustomEvalWrapper(t *testing.T) {
+	fs := fakeFileSystem{
+		fakeReadFile: func(filename string) ([]byte, error) {
+			switch filename {
+			case "manifest.MF":
+				return []byte("it's\nmodule\n"), nil
+			case "it's":
+				return []byte("a content"), nil
+			case "module":
+				return []byte("goog.module('hello');"), nil
+			default:
+				return []byte{}, fmt.Errorf("unexpected file read: %s", filename)
+			}
+		},
+		fakeStatMtime: func(filename string) (time.Time, error) {
+			return time.Time{}, nil
+		},
+	}
+	wrapper := template.Must(template.New("define").Parse("define('{{.QuotedPath}}', function() { eval('{{.Contents}}'); });\n"))
+
+	handler := ServeConcatenatedJS("manifest.MF", "", nil, nil, &fs, EvalWrapper(wrapper))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	got := w.Body.String()
+	want := `// it's
+define('it\'s', function() { eval('a content\n\n//# sourceURL=http://concatjs/it\'s\n'); });
+// module
+goog.loadModule('goog.module(\'hello\');\n\n//# sourceURL=http://concatjs/module\n');
+`
+	if got != want {
+		t.Errorf("Response differs, want %s, got %s", want, got)
+	}
+}
+
 func TestFileCaching(t *testing.T) {
 	var reads int
 
@@ -102,6 +217,425 @@ func TestFileCaching(t *testing.T) {
 	}
 }
 
+func TestServeManifestFromFileSystem(t *testing.T) {
+	fs := fakeFileSystem{
+		fakeReadFile: func(filename string) ([]byte, error) {
+			switch filename {
+			case "root/manifest.MF":
+				return []byte("a\n\nb\n"), nil
+			case "root/a":
+				return []byte("a content"), nil
+			case "root/b":
+				return []byte("b content"), nil
+			default:
+				return []byte{}, fmt.Errorf("unexpected file read: %s", filename)
+			}
+		},
+		fakeStatMtime: func(filename string) (time.Time, error) {
+			return time.Time{}, nil
+		},
+	}
+
+	handler := ServeConcatenatedJS("manifest.MF", "root", nil, nil, &fs)
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("HTTP request failed: %d", w.Code)
+	}
+
+	got := w.Body.String()
+	want := `// a
+eval('a content\n\n//# sourceURL=http://concatjs/a\n');
+// b
+eval('b content\n\n//# sourceURL=http://concatjs/b\n');
+`
+	if got != want {
+		t.Errorf("Response differs, want %s, got %s", want, got)
+	}
+}
+
+func TestLastModified(t *testing.T) {
+	mtime := time.Date(2017, 1, 2, 15, 4, 5, 500*1000*1000, time.UTC)
+	fs := fakeFileSystem{
+		fakeReadFile: func(filename string) ([]byte, error) {
+			if filename == "manifest.MF" {
+				return []byte("a\n"), nil
+			}
+			return []byte("a content"), nil
+		},
+		fakeStatMtime: func(filename string) (time.Time, error) {
+			if filename == "manifest.MF" {
+				return mtime.Add(-time.Hour), nil
+			}
+			return mtime, nil
+		},
+	}
+	handler := ServeConcatenatedJS("manifest.MF", "", nil, nil, &fs)
+
+	tests := []struct {
+		ifModifiedSince string
+		wantCode        int
+	}{
+		{ifModifiedSince: "", wantCode: http.StatusOK},
+		{ifModifiedSince: "not a date", wantCode: http.StatusOK},
+		{ifModifiedSince: "Mon, 02 Jan 2017 15:04:04 GMT", wantCode: http.StatusOK},
+		{ifModifiedSince: "Mon, 02 Jan 2017 15:04:05 GMT", wantCode: http.StatusNotModified},
+		{ifModifiedSince: "Mon, 02 Jan 2017 15:04:06 GMT", wantCode: http.StatusNotModified},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if test.ifModifiedSince != "" {
+			req.Header.Set("If-Modified-Since", test.ifModifiedSince)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != test.wantCode {
+			t.Errorf("If-Modified-Since %q: got status %d, want %d", test.ifModifiedSince, w.Code, test.wantCode)
+		}
+		if got, want := w.Header().Get("Last-Modified"), "Mon, 02 Jan 2017 15:04:05 GMT"; got != want {
+			t.Errorf("If-Modified-Since %q: got Last-Modified %q, want %q", test.ifModifiedSince, got, want)
+		}
+		if test.wantCode == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("If-Modified-Since %q: got body %q for not modified response", test.ifModifiedSince, w.Body.String())
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	fs := fakeFileSystem{
+		fakeReadFile: func(filename string) ([]byte, error) {
+			if filename == "manifest.MF" {
+				return []byte("a\n"), nil
+			}
+			return []byte("a content"), nil
+		},
+		fakeStatMtime: func(filename string) (time.Time, error) {
+			return time.Time{}, nil
+		},
+	}
+
+	tests := []struct {
+		opts       []Option
+		method     string
+		wantCode   int
+		wantOrigin string
+	}{
+		{method: "GET", wantCode: http.StatusOK, wantOrigin: ""},
+		{opts: []Option{CORSOrigin("*")}, method: "GET", wantCode: http.StatusOK, wantOrigin: "*"},
+		{opts: []Option{CORSOrigin("http://app.example.com")}, method: "GET", wantCode: http.StatusOK, wantOrigin: "http://app.example.com"},
+		{opts: []Option{CORSOrigin("http://app.example.com")}, method: "OPTIONS", wantCode: http.StatusNoContent, wantOrigin: "http://app.example.com"},
+	}
+	for _, test := range tests {
+		handler := ServeConcatenatedJS("manifest.MF", "", nil, nil, &fs, test.opts...)
+		req := httptest.NewRequest(test.method, "/", nil)
+		req.Header.Set("Origin", "http://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		req.Header.Set("Access-Control-Request-Headers", "X-Requested-With")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != test.wantCode {
+			t.Errorf("%s with %d options: got status %d, want %d", test.method, len(test.opts), w.Code, test.wantCode)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != test.wantOrigin {
+			t.Errorf("%s with %d options: got Access-Control-Allow-Origin %q, want %q", test.method, len(test.opts), got, test.wantOrigin)
+		}
+		if test.method == "OPTIONS" {
+			if got, want := w.Header().Get("Access-Control-Allow-Headers"), "X-Requested-With"; got != want {
+				t.Errorf("preflight: got Access-Control-Allow-Headers %q, want %q", got, want)
+			}
+			if w.Body.Len() != 0 {
+				t.Errorf("preflight: got body %q, want none", w.Body.String())
+			}
+		}
+	}
+}
+
+func TestMultipleManifests(t *testing.T) {
+	fs := fakeFileSystem{
+		fakeReadFile: func(filename string) ([]byte, error) {
+			switch filename {
+			case "first.MF":
+				return []byte("a\nshared\n"), nil
+			case "second.MF":
+				return []byte("shared\nb\n"), nil
+			case "a", "b", "shared":
+				return []byte(filename + " content"), nil
+			default:
+				return []byte{}, fmt.Errorf("unexpected file read: %s", filename)
+			}
+		},
+		fakeStatMtime: func(filename string) (time.Time, error) {
+			return time.Time{}, nil
+		},
+	}
+
+	tests := []struct {
+		opts []Option
+		want string
+	}{
+		{
+			want: `// a
+eval('a content\n\n//# sourceURL=http://concatjs/a\n');
+// shared
+eval('shared content\n\n//# sourceURL=http://concatjs/shared\n');
+// shared
+eval('shared content\n\n//# sourceURL=http://concatjs/shared\n');
+// b
+eval('b content\n\n//# sourceURL=http://concatjs/b\n');
+`,
+		},
+		{
+			opts: []Option{DedupAcrossManifests()},
+			want: `// a
+eval('a content\n\n//# sourceURL=http://concatjs/a\n');
+// shared
+eval('shared content\n\n//# sourceURL=http://concatjs/shared\n');
+// b
+eval('b content\n\n//# sourceURL=http://concatjs/b\n');
+`,
+		},
+	}
+	for _, test := range tests {
+		handler := ServeConcatenatedJSManifests([]string{"first.MF", "second.MF"}, "", nil, nil, &fs, test.opts...)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if got := w.Body.String(); got != test.want {
+			t.Errorf("Response with %d options differs, want %s, got %s", len(test.opts), test.want, got)
+		}
+	}
+}
+
+func TestMultipleManifestsReadSharedFileOnce(t *testing.T) {
+	var mu sync.Mutex // Guards reads.
+	reads := map[string]int{}
+	fs := fakeFileSystem{
+		fakeReadFile: func(filename string) ([]byte, error) {
+			switch filename {
+			case "first.MF":
+				return []byte("a\nshared\n"), nil
+			case "second.MF":
+				return []byte("shared\nb\n"), nil
+			}
+			mu.Lock()
+			reads[filename]++
+			mu.Unlock()
+			return []byte(filename + " content"), nil
+		},
+		fakeStatMtime: func(filename string) (time.Time, error) {
+			return time.Time{}, nil
+		},
+	}
+
+	handler := ServeConcatenatedJSManifests([]string{"first.MF", "second.MF"}, "", nil, nil, &fs)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("HTTP request failed: %d", w.Code)
+	}
+	for _, path := range []string{"a", "shared", "b"} {
+		if reads[path] != 1 {
+			t.Errorf("got %d reads of %s, want 1", reads[path], path)
+		}
+	}
+}
+
+func TestMultipleManifestsError(t *testing.T) {
+	fs := fakeFileSystem{
+		fakeReadFile: func(filename string) ([]byte, error) {
+			if filename == "good.MF" {
+				return []byte("a\n"), nil
+			}
+			return []byte{}, fmt.Errorf("no such file")
+		},
+		fakeStatMtime: func(filename string) (time.Time, error) {
+			return time.Time{}, nil
+		},
+	}
+
+	handler := ServeConcatenatedJSManifests([]string{"good.MF", "bad.MF"}, "", nil, nil, &fs)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	got := w.Body.String()
+	want := "throw new Error('Failed to read manifest: could not read manifest bad.MF: no such file');\n"
+	if got != want {
+		t.Errorf("Response differs, want %s, got %s", want, got)
+	}
+}
+
+func TestDedupWithinManifest(t *testing.T) {
+	fs := fakeFileSystem{
+		fakeReadFile: func(filename string) ([]byte, error) {
+			switch filename {
+			case "manifest.MF":
+				return []byte("a\nb\na\n"), nil
+			case "a", "b":
+				return []byte(filename + " content"), nil
+			default:
+				return []byte{}, fmt.Errorf("unexpected file read: %s", filename)
+			}
+		},
+		fakeStatMtime: func(filename string) (time.Time, error) {
+			return time.Time{}, nil
+		},
+	}
+
+	tests := []struct {
+		opts []Option
+		want string
+	}{
+		{
+			want: `// a
+eval('a content\n\n//# sourceURL=http://concatjs/a\n');
+// b
+eval('b content\n\n//# sourceURL=http://concatjs/b\n');
+// a
+eval('a content\n\n//# sourceURL=http://concatjs/a\n');
+`,
+		},
+		{
+			opts: []Option{DedupWithinManifest()},
+			want: `// a
+eval('a content\n\n//# sourceURL=http://concatjs/a\n');
+// b
+eval('b content\n\n//# sourceURL=http://concatjs/b\n');
+`,
+		},
+	}
+	for _, test := range tests {
+		handler := ServeConcatenatedJS("manifest.MF", "", nil, nil, &fs, test.opts...)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if got := w.Body.String(); got != test.want {
+			t.Errorf("Response with %d options differs, want %s, got %s", len(test.opts), test.want, got)
+		}
+	}
+}
+
+func TestExpandManifestPaths(t *testing.T) {
+	root, err := ioutil.TempDir("", "concatjs_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	srcs := filepath.Join(root, "srcs")
+	if err := os.Mkdir(srcs, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := "${SRCS}/a.js\n$UNSET/b.js\n$UNSET/$UNSET/c.js\n$UNSET/$OTHER/d.js\n"
+	if err := ioutil.WriteFile(filepath.Join(root, "manifest.MF"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(srcs, "a.js"), []byte("a content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"SRCS": srcs}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	handler := ServeConcatenatedJS("manifest.MF", root, nil, nil, nil, ExpandManifestPaths(lookup))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	got := w.Body.String()
+	want := `// srcs/a.js
+eval('a content\n\n//# sourceURL=http://concatjs/srcs/a.js\n');
+// $UNSET/b.js
+throw new Error('loading $UNSET/b.js failed: variable UNSET is not set');
+// $UNSET/$UNSET/c.js
+throw new Error('loading $UNSET/$UNSET/c.js failed: variable UNSET is not set');
+// $UNSET/$OTHER/d.js
+throw new Error('loading $UNSET/$OTHER/d.js failed: variables UNSET, OTHER are not set');
+`
+	if got != want {
+		t.Errorf("Response differs, want %s, got %s", want, got)
+	}
+}
+
+func TestExpandManifestPathsChangedValue(t *testing.T) {
+	fs := fakeFileSystem{
+		fakeReadFile: func(filename string) ([]byte, error) {
+			if filename == "manifest.MF" {
+				return []byte("${DIR}/a.js\n"), nil
+			}
+			return []byte("x " + filename), nil
+		},
+		fakeStatMtime: func(filename string) (time.Time, error) {
+			// Both candidate files share an mtime.
+			return time.Time{}, nil
+		},
+	}
+	env := map[string]string{"DIR": "one"}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	handler := ServeConcatenatedJS("manifest.MF", "", nil, nil, &fs, ExpandManifestPaths(lookup))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	env["DIR"] = "two"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	got := w.Body.String()
+	want := `// two/a.js
+eval('x two/a.js\n\n//# sourceURL=http://concatjs/two/a.js\n');
+`
+	if got != want {
+		t.Errorf("Response differs, want %s, got %s", want, got)
+	}
+}
+
+func TestExpandManifestPathsDedup(t *testing.T) {
+	fs := fakeFileSystem{
+		fakeReadFile: func(filename string) ([]byte, error) {
+			switch filename {
+			case "first.MF":
+				return []byte("${S}/a.js\nsrcs/a.js\n"), nil
+			case "second.MF":
+				return []byte("srcs/a.js\n"), nil
+			}
+			return []byte("a content"), nil
+		},
+		fakeStatMtime: func(filename string) (time.Time, error) {
+			return time.Time{}, nil
+		},
+	}
+	lookup := func(name string) (string, bool) {
+		if name == "S" {
+			return "srcs", true
+		}
+		return "", false
+	}
+	once := `// srcs/a.js
+eval('a content\n\n//# sourceURL=http://concatjs/srcs/a.js\n');
+`
+
+	tests := []struct {
+		manifests []string
+		opt       Option
+		want      string
+	}{
+		{manifests: []string{"first.MF"}, opt: DedupWithinManifest(), want: once},
+		{manifests: []string{"first.MF", "second.MF"}, opt: DedupAcrossManifests(), want: once + once},
+		{manifests: []string{"first.MF", "second.MF"}, opt: DedupWithinManifest(), want: once + once},
+	}
+	for _, test := range tests {
+		handler := ServeConcatenatedJSManifests(test.manifests, "", nil, nil, &fs, ExpandManifestPaths(lookup), test.opt)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if got := w.Body.String(); got != test.want {
+			t.Errorf("Response for %v differs, want %s, got %s", test.manifests, test.want, got)
+		}
+	}
+}
+
 func TestAcceptHeader(t *testing.T) {
 	tests := []struct {
 		header   map[string][]string